@@ -4,10 +4,84 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
 )
 
+// ValidationSummary is a structured tally of a Validate run, so callers can consume the
+// outcome programmatically instead of scraping kubeconform's text output.
+type ValidationSummary struct {
+	// Total is the number of manifests/kustomizations considered for validation.
+	Total int
+
+	// Valid is the number of manifests that passed validation.
+	Valid int
+
+	// Invalid is the number of manifests that failed validation.
+	Invalid int
+
+	// Errors maps a manifest/kustomization path to the kubeconform message reported for it.
+	Errors map[string]string
+}
+
+// ValidationResult is the outcome of a Validate run.
+type ValidationResult struct {
+	// Stdout is the combined kubeconform output for every validated manifest.
+	Stdout string
+
+	// Summary is a structured tally of the validation run.
+	Summary ValidationSummary
+}
+
+// validationTarget is one unit of work dispatched to a worker: a cluster manifest or a
+// kustomization directory validated by a single kubeconform invocation.
+type validationTarget struct {
+	mode string // "file" or "kustomize"
+	path string
+}
+
+// validationOutcome is the result of running a single validationTarget.
+type validationOutcome struct {
+	target validationTarget
+	stdout string
+	failed bool
+	errMsg string
+}
+
+// kubeconformJSON is the shape of kubeconform's `-output json` report.
+type kubeconformJSON struct {
+	Resources []struct {
+		Filename string `json:"filename"`
+		Kind     string `json:"kind"`
+		Name     string `json:"name"`
+		Status   string `json:"status"`
+		Msg      string `json:"msg"`
+	} `json:"resources"`
+}
+
+// kubeconformError extracts the messages of every non-valid resource from a kubeconform
+// `-output json` report. It returns "" when stdout doesn't parse as JSON or every resource is
+// valid.
+func kubeconformError(stdout string) string {
+	var report kubeconformJSON
+	if err := json.Unmarshal([]byte(stdout), &report); err != nil {
+		return ""
+	}
+
+	var messages []string
+	for _, resource := range report.Resources {
+		if resource.Status != "valid" && resource.Msg != "" {
+			messages = append(messages, fmt.Sprintf("%s %s: %s", resource.Kind, resource.Name, resource.Msg))
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
 type Flux struct {
 	// Base directory to walk through in order to validate Kubernetes manifests.
 	// +default="."
@@ -46,10 +120,20 @@ func New(
 }
 
 func containerWithRequirements() *Container {
-	var packages = []string{"bash", "curl", "git", "kustomize", "yq"}
+	var packages = []string{"bash", "curl", "diffutils", "git", "kustomize", "yq"}
 	return dag.Apko().Wolfi(packages)
 }
 
+// sourcesFileContents renders the sourceNames/sourceDirs pairing mounted under /sources as
+// "name=/sources/name" lines for consumption by the run_diff.sh script.
+func sourcesFileContents(sourceNames []string) string {
+	var lines []string
+	for _, name := range sourceNames {
+		lines = append(lines, fmt.Sprintf("%s=/sources/%s", name, name))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
 // Extract file from a given archive
 func extractFileFromURL(archiveURL string, filePath string) (*File, error) {
 	ctr := containerWithRequirements()
@@ -76,6 +160,20 @@ func extractToDirFromURL(archiveURL string, dirPath string) (*Directory, error)
 		Directory(dirPath), nil
 }
 
+// excludedFluxPath reports whether path falls under one of the directories/files that
+// Validate always skips (terraform, .github, pre-commit config). path is relative to the
+// directory being walked (as returned by Directory.Glob) and so may have no leading slash;
+// excluded directories are matched by segment rather than by substring.
+func excludedFluxPath(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "terraform" || segment == ".github" {
+			return true
+		}
+	}
+	base := filepath.Base(path)
+	return base == ".tfsec.yaml" || base == ".pre-commit-config.yaml"
+}
+
 // Walk through a given directory and check that the manifests are valid
 func (f *Flux) Validate(
 	ctx context.Context,
@@ -86,60 +184,277 @@ func (f *Flux) Validate(
 	kustomizeDir *Directory,
 
 	clustersDir *Directory,
-) (string, error) {
+
+	// parallelism is the number of manifests/kustomizations validated concurrently.
+	// +optional
+	// +default=0
+	parallelism int,
+) (*ValidationResult, error) {
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
 
 	kubeconformBin, err := extractFileFromURL(fmt.Sprintf("https://github.com/yannh/kubeconform/releases/download/%s/kubeconform-linux-amd64.tar.gz", kubeconformVersion), "/usr/local/bin/kubeconform")
 	if err != nil {
-		return "", fmt.Errorf("Cannot extract Kubeconform binary: %v", err)
+		return nil, fmt.Errorf("Cannot extract Kubeconform binary: %v", err)
 	}
 
 	fluxSchemasDir, err := extractToDirFromURL("https://github.com/fluxcd/flux2/releases/latest/download/crd-schemas.tar.gz", "/work/flux-crd-schemas/master-standalone-strict")
 	if err != nil {
-		return "", fmt.Errorf("Cannot extract Flux CRD schemas: %v", err)
+		return nil, fmt.Errorf("Cannot extract Flux CRD schemas: %v", err)
 	}
-	ctr := containerWithRequirements()
 
-	return ctr.
+	baseCtr := containerWithRequirements().
 		WithWorkdir("/work").
-		WithMountedDirectory("/kustomize", f.KustomizeDir).
+		WithMountedDirectory("/kustomize", kustomizeDir).
 		WithMountedDirectory("/clusters", clustersDir).
 		WithFile("/work/kubeconform", kubeconformBin, ContainerWithFileOpts{Permissions: 0750}).
-		WithMountedDirectory("/flux-crd-schemas/master-standalone-strict", fluxSchemasDir).
-		WithNewFile("/work/run_kubeconform.sh", ContainerWithNewFileOpts{
+		WithMountedDirectory("/flux-crd-schemas/master-standalone-strict", fluxSchemasDir)
+
+	var targets []validationTarget
+
+	clusterFiles, err := clustersDir.Glob(ctx, "**/*.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to enumerate cluster manifests: %v", err)
+	}
+	ymlFiles, err := clustersDir.Glob(ctx, "**/*.yml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to enumerate cluster manifests: %v", err)
+	}
+	for _, file := range append(clusterFiles, ymlFiles...) {
+		if excludedFluxPath(file) {
+			continue
+		}
+		targets = append(targets, validationTarget{mode: "file", path: filepath.Join("/clusters", file)})
+	}
+
+	kustomizationFiles, err := kustomizeDir.Glob(ctx, "**/kustomization.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to enumerate kustomizations: %v", err)
+	}
+	for _, file := range kustomizationFiles {
+		if excludedFluxPath(file) {
+			continue
+		}
+		targets = append(targets, validationTarget{mode: "kustomize", path: filepath.Join("/kustomize", file)})
+	}
+
+	kubeconformArgs := []string{"-strict", "-summary", "-output", "json", "-ignore-missing-schemas", "-schema-location", "default", "--schema-location", "/flux-crd-schemas"}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(parallelism)
+
+	outcomes := make([]validationOutcome, len(targets))
+	for idx, target := range targets {
+		idx, target := idx, target
+		g.Go(func() error {
+			var itemCtr *Container
+			if target.mode == "kustomize" {
+				itemCtr = baseCtr.WithExec(
+					[]string{"bash", "-c", fmt.Sprintf(`kustomize build %q | /work/kubeconform %s -`, filepath.Dir(target.path), strings.Join(kubeconformArgs, " "))},
+					ContainerWithExecOpts{Expect: ReturnTypeAny},
+				)
+			} else {
+				itemCtr = baseCtr.WithExec(
+					append([]string{"/work/kubeconform"}, append(kubeconformArgs, target.path)...),
+					ContainerWithExecOpts{Expect: ReturnTypeAny},
+				)
+			}
+
+			stdout, err := itemCtr.Stdout(gctx)
+			if err != nil {
+				outcomes[idx] = validationOutcome{target: target, failed: true}
+				return nil
+			}
+
+			exitCode, err := itemCtr.ExitCode(gctx)
+			if err != nil {
+				outcomes[idx] = validationOutcome{target: target, stdout: stdout, failed: true}
+				return nil
+			}
+
+			outcome := validationOutcome{target: target, stdout: stdout, failed: exitCode != 0}
+			if outcome.failed {
+				outcome.errMsg = kubeconformError(stdout)
+				if outcome.errMsg == "" {
+					outcome.errMsg = "validation failed"
+				}
+			}
+			outcomes[idx] = outcome
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, fmt.Errorf("validation failed: %v", err)
+	}
+
+	var stdoutBuilder strings.Builder
+	summary := ValidationSummary{Total: len(outcomes), Errors: map[string]string{}}
+	for _, outcome := range outcomes {
+		fmt.Fprintf(&stdoutBuilder, "### %s: %s\n%s\n", outcome.target.mode, outcome.target.path, outcome.stdout)
+		if outcome.failed {
+			summary.Invalid++
+			summary.Errors[outcome.target.path] = outcome.errMsg
+		} else {
+			summary.Valid++
+		}
+	}
+
+	return &ValidationResult{Stdout: stdoutBuilder.String(), Summary: summary}, nil
+}
+
+// Diff renders the Flux Kustomizations found in clustersDir against two revisions of the
+// kustomize tree (e.g. a PR branch vs. main), applies postBuild substitutions, sorts the
+// rendered resources, and returns a unified diff grouped per Flux Kustomization. It returns
+// a non-nil error when drift is detected so it can drive PR-comment workflows.
+func (f *Flux) Diff(
+	ctx context.Context,
+
+	// Kustomize directory for the first revision (e.g. the PR branch).
+	kustomizeDirA *Directory,
+
+	// Kustomize directory for the second revision (e.g. main).
+	kustomizeDirB *Directory,
+
+	// Directory containing the Flux Kustomization manifests to diff.
+	clustersDir *Directory,
+
+	// Flux version to use for postBuild substitutions.
+	// +optional
+	// +default="2.5.1"
+	fluxVersion string,
+
+	// sourceNames lists the GitRepository/OCIRepository names, in the same order as sourceDirs,
+	// that should resolve to a local directory instead of kustomizeDirA/kustomizeDirB. A source
+	// not listed here keeps resolving from the revision's own working tree.
+	// +optional
+	sourceNames []string,
+
+	// sourceDirs are the local directories corresponding to sourceNames, used to resolve
+	// GitRepository/OCIRepository references inside the Flux Kustomizations.
+	// +optional
+	sourceDirs []*Directory,
+) (string, error) {
+	if fluxVersion == "" {
+		fluxVersion = "2.5.1"
+	}
+
+	if len(sourceNames) != len(sourceDirs) {
+		return "", fmt.Errorf("sourceNames and sourceDirs must have the same length, got %d and %d", len(sourceNames), len(sourceDirs))
+	}
+
+	fluxBin, err := extractFileFromURL(fmt.Sprintf("https://github.com/fluxcd/flux2/releases/download/v%s/flux_%s_linux_amd64.tar.gz", fluxVersion, fluxVersion), "/usr/local/bin/flux")
+	if err != nil {
+		return "", fmt.Errorf("Cannot extract Flux binary: %v", err)
+	}
+
+	ctr := containerWithRequirements().
+		WithFile("/usr/local/bin/flux", fluxBin, ContainerWithFileOpts{Permissions: 0750}).
+		WithWorkdir("/work").
+		WithMountedDirectory("/revision-a", kustomizeDirA).
+		WithMountedDirectory("/revision-b", kustomizeDirB).
+		WithMountedDirectory("/clusters", clustersDir)
+
+	for idx, name := range sourceNames {
+		ctr = ctr.WithMountedDirectory(fmt.Sprintf("/sources/%s", name), sourceDirs[idx])
+	}
+
+	ctr = ctr.
+		WithNewFile("/work/sources.txt", ContainerWithNewFileOpts{
+			Contents: sourcesFileContents(sourceNames),
+		}).
+		WithNewFile("/work/run_diff.sh", ContainerWithNewFileOpts{
 			Permissions: 0750,
 			Contents: `#!/bin/bash
-# Process all YAML files in the given directory with kubeconform
-set -e
-
-# Define excluded directories and ignored files for find command
-excluded_directories=("*/terraform/*" "*/.github/*")
-ignored_files=(".tfsec.yaml" ".pre-commit-config.yaml")
-
-process_file() {
-  echo "Processing file: $1"
-  /work/kubeconform -strict -summary -ignore-missing-schemas -schema-location default --schema-location /flux-crd-schemas $1
-  if [ $? -ne 0 ]; then
-    exit 1
+# Diff every Flux Kustomization found under /clusters between two revisions of the
+# kustomize tree, resolving GitRepository/OCIRepository sources to local directories.
+set -o pipefail
+
+mkdir -p /tmp/rendered-a /tmp/rendered-b
+
+declare -A SOURCE_MAP
+while IFS='=' read -r name path; do
+  [ -n "$name" ] && [ -n "$path" ] && SOURCE_MAP["$name"]="$path"
+done < /work/sources.txt
+
+resolve_base() {
+  local source_name=$1
+  local default_dir=$2
+  if [ -n "${SOURCE_MAP[$source_name]:-}" ]; then
+    echo "${SOURCE_MAP[$source_name]}"
+  else
+    echo "$default_dir"
   fi
 }
 
-export -f process_file
+render() {
+  local base_dir=$1
+  local ks_path=$2
+  local vars_file=$3
+  local out_file=$4
+
+  if [ -n "$vars_file" ] && [ -s "$vars_file" ]; then
+    set -a
+    source "$vars_file"
+    set +a
+  fi
+
+  kustomize build "${base_dir%/}/${ks_path}" \
+    | flux envsubst \
+    | yq eval-all '[.] | sort_by(.apiVersion, .kind, .metadata.namespace, .metadata.name) | .[] | split_doc' - \
+    > "$out_file"
+}
+
+drift=0
+while IFS= read -r -d '' ks_file; do
+  kind=$(yq e '.kind' "$ks_file")
+  api=$(yq e '.apiVersion' "$ks_file")
+  case "$api" in
+    kustomize.toolkit.fluxcd.io/*) ;;
+    *) continue ;;
+  esac
+  [ "$kind" = "Kustomization" ] || continue
+
+  name=$(yq e '.metadata.name' "$ks_file")
+  ks_path=$(yq e '.spec.path' "$ks_file")
+  source_name=$(yq e '.spec.sourceRef.name' "$ks_file")
+
+  vars_file="/tmp/${name}.env"
+  yq e '(.spec.postBuild.substitute // {}) | to_entries | .[] | .key + "=" + .value' "$ks_file" > "$vars_file"
+
+  base_a=$(resolve_base "$source_name" "/revision-a")
+  base_b=$(resolve_base "$source_name" "/revision-b")
 
-echo -e "\n\e[32m✔\e[0m Validating Flux clusters manifests with kubeconform"
-for file in $(find /clusters -type f -name "*.y*ml" ! \( -path "${excluded_directories[0]}" -o -path "${excluded_directories[1]}" -o -name "${ignored_files[0]}" -o -name "${ignored_files[1]}" \)); do
-  bash -c 'process_file "$0"' $file || exit 1
-done
+  out_a="/tmp/rendered-a/${name}.yaml"
+  out_b="/tmp/rendered-b/${name}.yaml"
 
-echo -e "\n\e[32m✔\e[0m Validating Kustomization manifests with kubeconform"
-for file in $(find /kustomize -type f -name "kustomization.yaml" ! \( -path "${excluded_directories[0]}" -o -path "${excluded_directories[1]}" -o -name "${ignored_files[0]}" -o -name "${ignored_files[1]}" \)); do
-  echo "Processing kustomization.yaml file: $file"
-  kustomize build $(dirname $file) | /work/kubeconform -strict -summary -ignore-missing-schemas -schema-location default --schema-location /flux-crd-schemas -
-  if [ $? -ne 0 ]; then
-    exit 1
+  render "$base_a" "$ks_path" "$vars_file" "$out_a"
+  render "$base_b" "$ks_path" "$vars_file" "$out_b"
+
+  echo "### Kustomization: ${name}"
+  if ! diff -u "$out_a" "$out_b"; then
+    drift=1
   fi
-done
+done < <(find /clusters -type f \( -name "*.yaml" -o -name "*.yml" \) -print0)
+
+[ "$drift" -eq 0 ]
 `,
-		}).
-		WithExec([]string{"bash", "run_kubeconform.sh", "."}).
-		Stdout(ctx)
+		})
+
+	diffCtr := ctr.WithExec([]string{"bash", "run_diff.sh"}, ContainerWithExecOpts{Expect: ReturnTypeAny})
+
+	out, err := diffCtr.Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to render Flux Kustomizations: %v", err)
+	}
+
+	exitCode, err := diffCtr.ExitCode(ctx)
+	if err != nil {
+		return out, fmt.Errorf("failed to determine drift status: %v", err)
+	}
+	if exitCode != 0 {
+		return out, fmt.Errorf("drift detected between the two revisions")
+	}
+
+	return out, nil
 }
@@ -12,6 +12,14 @@
 //
 // - Support Flux variables substitution.
 //
+// - Builds Flux Kustomization YAML files honoring postBuild.substitute/substituteFrom.
+//
+// - Caches CRD-to-JSONSchema conversions across runs.
+//
+// - Can run as a KRM function (`kustomize fn` / `kpt fn`) via ValidateKRM.
+//
+// - Validates manifests concurrently across a worker pool and returns a structured summary.
+//
 // Refer to the Readme for more information on how to use this module: https://github.com/Smana/daggerverse/tree/main/kubeconform
 
 package main
@@ -19,14 +27,17 @@ package main
 import (
 	"context"
 	"dagger/kubeconform/internal/dagger"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"path"
+	"runtime"
 	"strconv"
 	"strings"
 
 	"github.com/mholt/archives"
+	"golang.org/x/sync/errgroup"
 )
 
 type Kubeconform struct {
@@ -36,8 +47,53 @@ type Kubeconform struct {
 	Version string
 }
 
+// ValidationSummary is a structured tally of a Validate run, so callers can consume the
+// outcome programmatically instead of scraping kubeconform's text output.
+type ValidationSummary struct {
+	// Total is the number of manifests considered for validation.
+	Total int
+
+	// Valid is the number of manifests that passed validation.
+	Valid int
+
+	// Invalid is the number of manifests that failed validation.
+	Invalid int
+
+	// Skipped is the number of manifests that couldn't be validated (a HelmRelease whose chart
+	// couldn't be resolved or rendered) and were left out of Valid/Invalid.
+	Skipped int
+
+	// Errors maps a manifest path to the error kubeconform reported for it.
+	Errors map[string]string
+}
+
+// ValidationResult is the outcome of a Validate run.
+type ValidationResult struct {
+	// Stdout is the combined kubeconform output for every validated manifest.
+	Stdout string
+
+	// Summary is a structured tally of the validation run.
+	Summary ValidationSummary
+}
+
+// validationTarget is one unit of work dispatched to a worker: a manifest/kustomization/Flux
+// Kustomization file validated by a single kubeconform invocation.
+type validationTarget struct {
+	mode string // "file", "kustomize" or "flux-kustomization"
+	path string
+}
+
+// validationOutcome is the result of running a single validationTarget.
+type validationOutcome struct {
+	target  validationTarget
+	stdout  string
+	valid   bool
+	skipped bool
+	errMsg  string
+}
+
 // kubeConformImage returns a container image with the required packages and tools to run kubeconform.
-func kubeConformImage(kubeconform_version string, flux bool, fluxVersion string, env []string) (*dagger.Container, error) {
+func kubeConformImage(kubeconform_version string, flux bool, fluxVersion string, helm bool, helmVersion string, env []string) (*dagger.Container, error) {
 	ctr := dag.Container().From("alpine:latest").
 		WithExec([]string{"apk", "add", "bash", "curl", "kustomize", "git", "python3", "py3-pip", "yq", "py3-yaml"})
 
@@ -58,6 +114,15 @@ func kubeConformImage(kubeconform_version string, flux bool, fluxVersion string,
 		ctr = ctr.WithFile("/bin/flux", fluxBin, dagger.ContainerWithFileOpts{Permissions: 0750})
 	}
 
+	if helm {
+		// Add the helm binary to the container
+		helmBin := dag.Arc().
+			Unarchive(dag.HTTP(fmt.Sprintf("https://get.helm.sh/helm-v%s-linux-amd64.tar.gz", helmVersion)).
+				WithName(fmt.Sprintf("helm-v%s-linux-amd64.tar.gz", helmVersion))).File("linux-amd64/helm")
+
+		ctr = ctr.WithFile("/bin/helm", helmBin, dagger.ContainerWithFileOpts{Permissions: 0750})
+	}
+
 	// Add the environment variables to the container
 	for _, e := range env {
 		parts := strings.Split(e, ":")
@@ -220,19 +285,70 @@ func (m *Kubeconform) Validate(
 	// a list of environment variables, expected in (key:value) format
 	// +optional
 	env []string,
-) (string, error) {
+
+	// fluxKustomizations is a list of Flux Kustomization YAML files to validate. Each one is
+	// built from its spec.path inside manifests, honoring postBuild.substitute inline values
+	// and postBuild.substituteFrom ConfigMap/Secret references resolved from manifests and
+	// varsDir.
+	// +optional
+	fluxKustomizations []*dagger.File,
+
+	// varsDir is an additional directory of ConfigMap/Secret manifests used to resolve
+	// postBuild.substituteFrom references that aren't found in manifests.
+	// +optional
+	varsDir *dagger.Directory,
+
+	// schemaCache is a cache volume used to persist CRD-to-JSONSchema conversions across runs,
+	// keyed by the sha256 of each CRD file. Sharing it across pipelines turns repeat CI runs
+	// from minutes into seconds.
+	// +optional
+	schemaCache *dagger.CacheVolume,
+
+	// refreshSchemas if set to true forces every CRD to be reconverted, ignoring the cache.
+	// +optional
+	refreshSchemas bool,
+
+	// parallelism is the number of manifests/kustomizations validated concurrently.
+	// +optional
+	// +default=0
+	parallelism int,
+
+	// helm if set to true renders HelmRelease manifests with `helm template` before validating
+	// them, resolving the chart source from a co-located "*-source.yaml" or from helmRepos.
+	// +optional
+	// +default=false
+	helm bool,
+
+	// helmVersion is the version of the helm binary to download.
+	// +optional
+	// +default="3.17.0"
+	helmVersion string,
+
+	// helmRepos maps HelmRepository names to chart repository URLs, in the form "name=url",
+	// used when a HelmRelease's source isn't resolvable from a co-located "*-source.yaml".
+	// +optional
+	helmRepos []string,
+) (*ValidationResult, error) {
 	if manifests == nil {
 		manifests = dag.Directory().Directory(".")
 	}
 
-	ctr, err := kubeConformImage(version, flux, fluxVersion, env)
+	if len(fluxKustomizations) > 0 {
+		flux = true
+	}
+
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+
+	ctr, err := kubeConformImage(version, flux, fluxVersion, helm, helmVersion, env)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	crdDirs, err := crdDirs(ctx, crds)
 	if err != nil {
-		return "", fmt.Errorf("failed to create the schemas directories: %v", err)
+		return nil, fmt.Errorf("failed to create the schemas directories: %v", err)
 	}
 
 	// Mount all the CRDs schemas directories into the container
@@ -244,147 +360,584 @@ func (m *Kubeconform) Validate(
 	ctr = ctr.WithMountedDirectory("/work", manifests).
 		WithWorkdir("/work")
 
-	// Create the script
-	scriptContent := `#!/bin/bash
-set -e
-set -o pipefail
-
-kustomize=0
-manifests_dir="."
-
-options=$(getopt -o kd: --long kustomize,flux,catalog,exclude:,manifests-dir: -- "$@")
-eval set -- "$options"
-
-while true; do
-  case $1 in
-    --kustomize|-k)
-      kustomize=1
-      shift
-      ;;
-    --flux)
-      flux=1
-      shift
-      ;;
-    --catalog)
-      catalog=1
-      shift
-      ;;
-    --exclude)
-      exclude=$2
-      shift 2
-      ;;
-    --manifests-dir|-d)
-      manifests_dir=$2
-      shift 2
-      ;;
-    --)
-      shift
-      break
-      ;;
-    *)
-      echo "Invalid option: $1" 1>&2
-      exit 1
-      ;;
-  esac
-done
-
-find_manifests() {
-  local dir=$1
-  local search_patterns=$2
-  local exclude_string=$3
-  local IFS=','
-
-  read -r -a pattern_array <<< "$search_patterns"
-  read -r -a exclude_array <<< "$exclude_string"
+	// Mount the Flux Kustomization files to build with their postBuild substitutions
+	for idx, file := range fluxKustomizations {
+		ctr = ctr.WithMountedFile(fmt.Sprintf("/flux-kustomizations/%s.yaml", strconv.Itoa(idx)), file)
+	}
 
-  find_command="find $dir"
+	// Mount the additional ConfigMap/Secret manifests used by postBuild.substituteFrom
+	if varsDir != nil {
+		ctr = ctr.WithMountedDirectory("/vars", varsDir)
+	}
 
-  for exclude in "${exclude_array[@]}"; do
-    find_command+=" -path '${exclude// /}' -prune -o"
-  done
+	// Mount the CRD-to-JSONSchema cache, keyed by each CRD's sha256.
+	if schemaCache != nil {
+		ctr = ctr.WithMountedCache("/schemas-cache", schemaCache)
+	}
 
-  find_command+=" \("
-  for pattern in "${pattern_array[@]}"; do
-    find_command+=" -name '${pattern// /}' -o"
-  done
-  find_command="${find_command% -o} \) -type f -print"
+	// Make the helmRepos "name=url" mappings available to run_item.sh's helm-release mode.
+	if helm {
+		ctr = ctr.WithNewFile("/work/helm-repos.txt", dagger.ContainerWithNewFileOpts{Contents: strings.Join(helmRepos, "\n") + "\n"})
+	}
 
-  eval "$find_command"
-}
+	// Convert the CRDs to JSON schemas once, shared by every worker below.
+	prepareSchemasScript := fmt.Sprintf(`#!/bin/bash
+set -e
+set -o pipefail
 
-# Convert all CRDs to JSON schemas
 mkdir -p /schemas
 if [ -d /crds ]; then
   find /crds -type f \( -name "*.yaml" -o -name "*.yml" \) -print0 | while IFS= read -r -d $'\0' file; do
     if yq e '.kind == "CustomResourceDefinition"' "$file"; then
-      echo "Converting $file to JSON Schema"
-      openapi2jsonschema.py "$file"
+      if [ -d /schemas-cache ]; then
+        hash=$(sha256sum "$file" | cut -d' ' -f1)
+        if [ %d -eq 0 ] && [ -f "/schemas-cache/${hash}.done" ]; then
+          echo "Using cached JSON Schema for $file"
+          cp "/schemas-cache/${hash}"/*.json /schemas/
+        else
+          echo "Converting $file to JSON Schema"
+          rm -rf "/schemas-cache/${hash}" && mkdir -p "/schemas-cache/${hash}"
+          (cd "/schemas-cache/${hash}" && openapi2jsonschema.py "$file")
+          touch "/schemas-cache/${hash}.done"
+          cp "/schemas-cache/${hash}"/*.json /schemas/
+        fi
+      else
+        echo "Converting $file to JSON Schema"
+        openapi2jsonschema.py "$file"
+        mv ./*.json "/schemas/"
+      fi
     fi
   done
-  mv ./*.json "/schemas/"
 fi
+`, boolToInt(refreshSchemas))
 
-ARGS=("-summary" "--strict" "-ignore-missing-schemas" "-schema-location" "default")
-
-# Add the schemas directories to the kubeconform arguments if they exist
-if [ -n "$(find $1 -type f -print -quit)" ]; then
-  ARGS+=("--schema-location" "/schemas/{{.ResourceKind}}_{{.ResourceAPIVersion}}.json")
-fi
-# Add the Datree catalog if enabled
-if [ $catalog -eq 1 ]; then
-  ARGS+=("--schema-location" "https://raw.githubusercontent.com/datreeio/CRDs-catalog/main/{{.Group}}/{{.ResourceKind}}_{{.ResourceAPIVersion}}.json")
-fi
+	// run_item.sh validates a single manifest/kustomization/Flux Kustomization. Dispatching one
+	// worker per item (instead of looping in bash) lets the Go driver below fan the work out
+	// across a worker pool.
+	runItemScript := `#!/bin/bash
+set -o pipefail
 
-if [ $kustomize -eq 1 ]; then
-  for file in $(find_manifests "$manifests_dir" "kustomization.yaml,kustomization.yml" "$exclude"); do
-    echo "Processing kustomization file: $file"
-    if [ $flux -eq 1 ]; then
-        if ! kustomize build $(dirname $file) | flux envsubst | kubeconform ${ARGS[@]} -; then
-          echo "Validation failed for $file"
-          exit 1
-        fi
-    else
-        if ! kustomize build $(dirname $file) | kubeconform ${ARGS[@]} -; then
-        echo "Validation failed for $file"
-        exit 1
+mode=$1
+target=$2
+shift 2
+ARGS=("$@")
+
+# substitute_vars_for resolves a Flux Kustomization's postBuild.substitute inline values and
+# postBuild.substituteFrom ConfigMap/Secret references into a KEY=VALUE file consumable by
+# `+"`flux envsubst`"+`.
+substitute_vars_for() {
+  local ks_file=$1
+  local vars_file=$2
+
+  yq e '(.spec.postBuild.substitute // {}) | to_entries | .[] | .key + "=" + .value' "$ks_file" > "$vars_file"
+
+  while IFS='|' read -r ref_kind ref_name; do
+    [ -z "$ref_kind" ] && continue
+    for vars_source_dir in /work /vars; do
+      [ -d "$vars_source_dir" ] || continue
+      find "$vars_source_dir" -type f \( -name "*.yaml" -o -name "*.yml" \) -print0 | while IFS= read -r -d $'\0' ref_file; do
+        ref_file_kind=$(yq e '.kind' "$ref_file" 2>/dev/null)
+        ref_file_name=$(yq e '.metadata.name' "$ref_file" 2>/dev/null)
+        if [ "$ref_file_kind" = "$ref_kind" ] && [ "$ref_file_name" = "$ref_name" ]; then
+          if [ "$ref_kind" = "Secret" ]; then
+            yq e '.data // {} | to_entries | .[] | .key + "=" + (.value | @base64d)' "$ref_file" >> "$vars_file"
+          else
+            yq e '.data // {} | to_entries | .[] | .key + "=" + .value' "$ref_file" >> "$vars_file"
+          fi
         fi
+      done
+    done
+  done < <(yq e '(.spec.postBuild.substituteFrom // []) | .[] | .kind + "|" + .name' "$ks_file")
+}
+
+# resolve_helm_repo finds the URL for a HelmRepository/HelmChart sourceRef, first from a
+# co-located "*-source.yaml" in the HelmRelease's directory, then from /work/helm-repos.txt.
+resolve_helm_repo() {
+  local hr_file=$1
+  local source_name=$2
+
+  for source_file in "$(dirname "$hr_file")"/*-source.yaml; do
+    [ -e "$source_file" ] || continue
+    if [ "$(yq e '.metadata.name' "$source_file" 2>/dev/null)" = "$source_name" ]; then
+      yq e '.spec.url' "$source_file"
+      return 0
     fi
-    echo "Validation successful for $file"
   done
-else
-  for file in $(find_manifests "$manifests_dir" "*.yaml,*.yml" "$exclude"); do
-    echo "Processing file: $file"
-    if ! kubeconform "${ARGS[@]}" $file; then
-      echo "Validation failed for $file"
-      exit 1
+
+  if [ -f /work/helm-repos.txt ]; then
+    while IFS='=' read -r name url; do
+      if [ "$name" = "$source_name" ] && [ -n "$url" ]; then
+        echo "$url"
+        return 0
+      fi
+    done < /work/helm-repos.txt
+  fi
+
+  return 1
+}
+
+# resolve_ref_file finds the manifest under /work whose kind and metadata.name match, as used to
+# locate a HelmRelease's valuesFrom ConfigMap/Secret reference.
+resolve_ref_file() {
+  local ref_kind=$1
+  local ref_name=$2
+
+  while IFS= read -r -d '' candidate; do
+    if [ "$(yq e '.kind' "$candidate" 2>/dev/null)" = "$ref_kind" ] && [ "$(yq e '.metadata.name' "$candidate" 2>/dev/null)" = "$ref_name" ]; then
+      echo "$candidate"
+      return 0
+    fi
+  done < <(find /work -type f \( -name "*.yaml" -o -name "*.yml" \) -print0)
+
+  return 1
+}
+
+# render_helm_release runs `helm template` for a Flux HelmRelease, resolving its chart source
+# and merging spec.values with spec.valuesFrom ConfigMap/Secret references. Each valuesFrom entry
+# is resolved by kind+name, its data[valuesKey] (default "values.yaml") extracted and, for
+# Secrets, base64-decoded, then merged as a YAML document (or set at targetPath when given),
+# mirroring Flux's ValuesReference semantics.
+render_helm_release() {
+  local hr_file=$1
+  local release_name chart source_name version repo_url repo_alias values_file
+
+  release_name=$(yq e '.metadata.name' "$hr_file")
+  chart=$(yq e '.spec.chart.spec.chart' "$hr_file")
+  version=$(yq e '.spec.chart.spec.version // "*"' "$hr_file")
+  source_name=$(yq e '.spec.chart.spec.sourceRef.name' "$hr_file")
+
+  repo_url=$(resolve_helm_repo "$hr_file" "$source_name") || {
+    echo "WARNING: could not resolve chart source for HelmRelease $release_name, skipping" 1>&2
+    return 1
+  }
+
+  repo_alias="repo-$(echo "$source_name" | tr -c 'a-zA-Z0-9' '-')"
+  helm repo add "$repo_alias" "$repo_url" >/dev/null 2>&1
+  helm repo update "$repo_alias" >/dev/null 2>&1
+
+  values_file="/tmp/$(basename "$hr_file" .yaml)-values.yaml"
+  yq e '.spec.values // {}' "$hr_file" > "$values_file"
+
+  values_from_count=$(yq e '(.spec.valuesFrom // []) | length' "$hr_file")
+  for ((vf_idx = 0; vf_idx < values_from_count; vf_idx++)); do
+    ref_kind=$(yq e ".spec.valuesFrom[$vf_idx].kind" "$hr_file")
+    ref_name=$(yq e ".spec.valuesFrom[$vf_idx].name" "$hr_file")
+    values_key=$(yq e ".spec.valuesFrom[$vf_idx].valuesKey // \"values.yaml\"" "$hr_file")
+    target_path=$(yq e ".spec.valuesFrom[$vf_idx].targetPath // \"\"" "$hr_file")
+
+    ref_file=$(resolve_ref_file "$ref_kind" "$ref_name") || {
+      echo "WARNING: could not resolve valuesFrom $ref_kind/$ref_name for HelmRelease $release_name" 1>&2
+      continue
+    }
+
+    raw_value=$(yq e ".data.\"${values_key}\" // \"\"" "$ref_file")
+    if [ "$ref_kind" = "Secret" ]; then
+      raw_value=$(printf '%s' "$raw_value" | base64 -d)
+    fi
+
+    if [ -n "$target_path" ]; then
+      yq e -i ".${target_path} = \"${raw_value}\"" "$values_file"
+    else
+      printf '%s\n' "$raw_value" > /tmp/valuesfrom-entry.yaml
+      yq e -i '. *= load("/tmp/valuesfrom-entry.yaml")' "$values_file"
     fi
-    echo "Validation successful for $file"
   done
-fi
+
+  helm template "$release_name" "${repo_alias}/${chart}" --version "$version" -f "$values_file"
+}
+
+case "$mode" in
+  file)
+    kubeconform "${ARGS[@]}" "$target"
+    ;;
+  kustomize)
+    if [ -n "$KUBECONFORM_FLUX" ]; then
+      kustomize build "$(dirname "$target")" | flux envsubst | kubeconform "${ARGS[@]}" -
+    else
+      kustomize build "$(dirname "$target")" | kubeconform "${ARGS[@]}" -
+    fi
+    ;;
+  flux-kustomization)
+    ks_path=$(yq e '.spec.path' "$target")
+    vars_file="/tmp/$(basename "$target" .yaml).env"
+    substitute_vars_for "$target" "$vars_file"
+    set -a
+    source "$vars_file"
+    set +a
+    kustomize build "/work/${ks_path}" | flux envsubst | kubeconform "${ARGS[@]}" -
+    ;;
+  helm-release)
+    if ! render_helm_release "$target" > /tmp/helm-rendered.yaml; then
+      # Chart source couldn't be resolved: skip cleanly (exit code 2) rather than failing.
+      exit 2
+    fi
+    kubeconform "${ARGS[@]}" /tmp/helm-rendered.yaml
+    ;;
+  *)
+    echo "unknown validation mode: $mode" 1>&2
+    exit 1
+    ;;
+esac
 `
 
-	// Add the manifests and the script to the container
-	ctr = ctr.
-		WithMountedDirectory("/work", manifests).
-		WithNewFile("/work/run_kubeconform.sh", scriptContent, dagger.ContainerWithNewFileOpts{Permissions: 0750})
-	// Execute the script
-	kubeconform_command := []string{"bash", "/work/run_kubeconform.sh"}
-	if kustomize {
-		kubeconform_command = append(kubeconform_command, "--kustomize")
-	}
+	baseCtr := ctr.
+		WithNewFile("/work/prepare_schemas.sh", dagger.ContainerWithNewFileOpts{Permissions: 0750, Contents: prepareSchemasScript}).
+		WithExec([]string{"bash", "/work/prepare_schemas.sh"}).
+		WithNewFile("/work/run_item.sh", dagger.ContainerWithNewFileOpts{Permissions: 0750, Contents: runItemScript})
 	if flux {
-		kubeconform_command = append(kubeconform_command, "--flux")
+		baseCtr = baseCtr.WithEnvVariable("KUBECONFORM_FLUX", "1")
 	}
+
+	kubeconformArgs := []string{"-summary", "-output", "json", "--strict", "-ignore-missing-schemas", "-schema-location", "default", "--schema-location", "/schemas/{{.ResourceKind}}_{{.ResourceAPIVersion}}.json"}
 	if catalog {
-		kubeconform_command = append(kubeconform_command, "--catalog")
+		kubeconformArgs = append(kubeconformArgs, "--schema-location", "https://raw.githubusercontent.com/datreeio/CRDs-catalog/main/{{.Group}}/{{.ResourceKind}}_{{.ResourceAPIVersion}}.json")
+	}
+
+	// Enumerate the manifests/kustomizations to validate.
+	var targets []validationTarget
+	for idx := range fluxKustomizations {
+		targets = append(targets, validationTarget{mode: "flux-kustomization", path: fmt.Sprintf("/flux-kustomizations/%d.yaml", idx)})
+	}
+
+	var manifestPatterns []string
+	if kustomize {
+		manifestPatterns = []string{"**/kustomization.yaml", "**/kustomization.yml"}
+	} else {
+		manifestPatterns = []string{"**/*.yaml", "**/*.yml"}
+	}
+
+	var manifestFiles []string
+	for _, pattern := range manifestPatterns {
+		entries, err := manifests.Glob(ctx, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to enumerate manifests: %v", err)
+		}
+		manifestFiles = append(manifestFiles, entries...)
+	}
+	manifestFiles = excludeMatches(manifestFiles, exclude)
+
+	// HelmRelease manifests are rendered via `helm template` rather than validated as-is, so
+	// they're detected separately from the file/kustomize walk below and excluded from it to
+	// avoid validating the same manifest twice (once raw, once rendered).
+	var helmReleaseList []string
+	helmReleaseFiles := map[string]bool{}
+	if helm {
+		var err error
+		helmReleaseList, err = helmReleaseManifests(ctx, manifests, exclude)
+		if err != nil {
+			return nil, fmt.Errorf("failed to detect HelmRelease manifests: %v", err)
+		}
+		for _, file := range helmReleaseList {
+			helmReleaseFiles[file] = true
+		}
+	}
+
+	mode := "file"
+	if kustomize {
+		mode = "kustomize"
+	}
+	for _, file := range manifestFiles {
+		if mode == "file" && helmReleaseFiles[file] {
+			continue
+		}
+		targets = append(targets, validationTarget{mode: mode, path: path.Join("/work", file)})
+	}
+
+	for _, file := range helmReleaseList {
+		targets = append(targets, validationTarget{mode: "helm-release", path: path.Join("/work", file)})
+	}
+
+	// Fan the validation out across a worker pool, sharing the schemas baked into baseCtr.
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(parallelism)
+
+	outcomes := make([]validationOutcome, len(targets))
+	for idx, target := range targets {
+		idx, target := idx, target
+		g.Go(func() error {
+			command := append([]string{"bash", "/work/run_item.sh", target.mode, target.path}, kubeconformArgs...)
+			itemCtr := baseCtr.WithExec(command, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+
+			stdout, err := itemCtr.Stdout(gctx)
+			if err != nil {
+				outcomes[idx] = validationOutcome{target: target, errMsg: err.Error()}
+				return nil
+			}
+
+			exitCode, err := itemCtr.ExitCode(gctx)
+			if err != nil {
+				outcomes[idx] = validationOutcome{target: target, stdout: stdout, errMsg: err.Error()}
+				return nil
+			}
+
+			outcome := validationOutcome{target: target, stdout: stdout, valid: exitCode == 0}
+			switch {
+			case exitCode == 2 && target.mode == "helm-release":
+				outcome.skipped = true
+			case exitCode != 0:
+				outcome.errMsg = kubeconformError(stdout)
+				if outcome.errMsg == "" {
+					outcome.errMsg = "validation failed"
+				}
+			}
+			outcomes[idx] = outcome
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, fmt.Errorf("validation failed: %v", err)
+	}
+
+	var stdoutBuilder strings.Builder
+	summary := ValidationSummary{Total: len(outcomes), Errors: map[string]string{}}
+	for _, outcome := range outcomes {
+		fmt.Fprintf(&stdoutBuilder, "### %s: %s\n%s\n", outcome.target.mode, outcome.target.path, outcome.stdout)
+		switch {
+		case outcome.skipped:
+			summary.Skipped++
+		case outcome.errMsg != "":
+			summary.Invalid++
+			summary.Errors[outcome.target.path] = outcome.errMsg
+		default:
+			summary.Valid++
+		}
+	}
+
+	return &ValidationResult{Stdout: stdoutBuilder.String(), Summary: summary}, nil
+}
+
+// boolToInt converts a bool to 0/1 for interpolation into generated shell scripts.
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// helmReleaseManifests returns the paths, relative to manifests, of every YAML file whose kind
+// is HelmRelease, so Validate can dispatch them as "helm-release" targets rendered via `helm
+// template` instead of validated as-is.
+func helmReleaseManifests(ctx context.Context, manifests *dagger.Directory, exclude string) ([]string, error) {
+	var candidates []string
+	for _, pattern := range []string{"**/*.yaml", "**/*.yml"} {
+		entries, err := manifests.Glob(ctx, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to enumerate manifests: %v", err)
+		}
+		candidates = append(candidates, entries...)
+	}
+	candidates = excludeMatches(candidates, exclude)
+
+	var helmReleases []string
+	for _, file := range candidates {
+		contents, err := manifests.File(file).Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		for _, line := range strings.Split(contents, "\n") {
+			if strings.TrimSpace(line) == "kind: HelmRelease" {
+				helmReleases = append(helmReleases, file)
+				break
+			}
+		}
+	}
+	return helmReleases, nil
+}
+
+// kubeconformJSON is the shape of kubeconform's `-output json` report.
+type kubeconformJSON struct {
+	Resources []struct {
+		Filename string `json:"filename"`
+		Kind     string `json:"kind"`
+		Name     string `json:"name"`
+		Status   string `json:"status"`
+		Msg      string `json:"msg"`
+	} `json:"resources"`
+}
+
+// kubeconformError extracts the messages of every non-valid resource from a kubeconform
+// `-output json` report. It returns "" when stdout doesn't parse as JSON or every resource is
+// valid.
+func kubeconformError(stdout string) string {
+	var report kubeconformJSON
+	if err := json.Unmarshal([]byte(stdout), &report); err != nil {
+		return ""
+	}
+
+	var messages []string
+	for _, resource := range report.Resources {
+		if resource.Status != "valid" && resource.Msg != "" {
+			messages = append(messages, fmt.Sprintf("%s %s: %s", resource.Kind, resource.Name, resource.Msg))
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// excludeMatches filters out paths matching any of the comma-separated patterns in exclude, either
+// as a path.Match glob or, once a leading "./" and a trailing "/*" are stripped, as a substring.
+func excludeMatches(files []string, exclude string) []string {
+	if exclude == "" {
+		return files
+	}
+
+	var patterns []string
+	for _, p := range strings.Split(exclude, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+
+	var filtered []string
+	for _, file := range files {
+		excluded := false
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, file); matched {
+				excluded = true
+				break
+			}
+			if strings.Contains(file, strings.TrimSuffix(strings.TrimPrefix(pattern, "./"), "/*")) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			filtered = append(filtered, file)
+		}
 	}
-	if exclude != "" {
-		kubeconform_command = append(kubeconform_command, "--exclude", exclude)
+	return filtered
+}
+
+// functionConfigList reads a comma-separated ConfigMap data value from functionConfig (KRM
+// ResourceList functionConfig data is string-only, so list-shaped flags are passed as
+// comma-separated strings rather than YAML lists).
+func functionConfigList(ctx context.Context, functionConfig *dagger.File, key string) ([]string, error) {
+	raw, err := dag.Container().From("alpine:latest").
+		WithExec([]string{"apk", "add", "--no-cache", "yq"}).
+		WithMountedFile("/work/function-config.yaml", functionConfig).
+		WithExec([]string{"yq", "e", fmt.Sprintf(".data.%s // \"\"", key), "/work/function-config.yaml"}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for _, v := range strings.Split(strings.TrimSpace(raw), ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			values = append(values, v)
+		}
 	}
-	stdout, err := ctr.WithExec(kubeconform_command).Stdout(ctx)
+	return values, nil
+}
+
+// ValidateKRM runs the same kubeconform + CRD-conversion pipeline as Validate, but speaks the
+// KRM Functions Specification: input is a kustomize ResourceList file (the document a KRM
+// function reads on stdin), and the same ResourceList is returned as a file with validation
+// results attached as results[] entries (severity "error"/"warning", or "info" for a resource
+// that validated; resource ref; file path). This lets the module be used as a `kustomize
+// fn` / `kpt fn` validator in addition to the shell-driven Validate entrypoint.
+//
+// Unlike Validate, ValidateKRM's input is already a flattened ResourceList rather than a
+// directory tree, so the kustomize/flux/env flags don't apply here: functionConfig's data only
+// carries "strict", "catalog" and "ignoreMissingSchemas" ("true"/"false", as ConfigMap data is
+// string-only), plus a comma-separated "crds" list of CRD URLs merged with the crds parameter.
+func (m *Kubeconform) ValidateKRM(
+	ctx context.Context,
+
+	// input is a kustomize ResourceList file, as defined by the KRM Functions Specification.
+	input *dagger.File,
+
+	// functionConfig is the ResourceList's functionConfig ConfigMap, carrying "strict", "catalog"
+	// and "ignoreMissingSchemas" plus a comma-separated "crds" list of CRD URLs in its data.
+	// +optional
+	functionConfig *dagger.File,
+
+	// crds is a list of URLs containing the CRDs to validate against, merged with any URLs
+	// listed in functionConfig's "crds" data key.
+	// +optional
+	crds []string,
+) (*dagger.File, error) {
+	if functionConfig == nil {
+		functionConfig = dag.Directory().WithNewFile("function-config.yaml", "data: {}\n").File("function-config.yaml")
+	}
+
+	configCrds, err := functionConfigList(ctx, functionConfig, "crds")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read functionConfig: %v", err)
+	}
+	crds = append(crds, configCrds...)
+
+	ctr, err := kubeConformImage(m.Version, false, "", false, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	crdDirs, err := crdDirs(ctx, crds)
 	if err != nil {
-		return "", fmt.Errorf("validation failed: %v", err)
+		return nil, fmt.Errorf("failed to create the schemas directories: %v", err)
 	}
+	for idx, dir := range crdDirs {
+		ctr = ctr.WithMountedDirectory(fmt.Sprintf("/crds/%s", strconv.Itoa(idx)), dir)
+	}
+
+	ctr = ctr.WithWorkdir("/work").
+		WithMountedFile("/work/resource-list.yaml", input).
+		WithMountedFile("/work/function-config.yaml", functionConfig)
+
+	scriptContent := `#!/bin/bash
+set -e
+set -o pipefail
+
+mkdir -p /work/items /schemas
+
+# Convert all CRDs to JSON schemas
+if [ -d /crds ]; then
+  find /crds -type f \( -name "*.yaml" -o -name "*.yml" \) -print0 | while IFS= read -r -d $'\0' file; do
+    if yq e '.kind == "CustomResourceDefinition"' "$file"; then
+      openapi2jsonschema.py "$file"
+    fi
+  done
+  mv ./*.json "/schemas/" 2>/dev/null || true
+fi
+
+ARGS=("-summary" "-output" "json" "-schema-location" "default")
+[ "$(yq e '.data.ignoreMissingSchemas // "true"' /work/function-config.yaml)" = "true" ] && ARGS+=("-ignore-missing-schemas")
+[ -n "$(find /schemas -type f -print -quit)" ] && ARGS+=("--schema-location" "/schemas/{{.ResourceKind}}_{{.ResourceAPIVersion}}.json")
+[ "$(yq e '.data.strict // "false"' /work/function-config.yaml)" = "true" ] && ARGS+=("--strict")
+[ "$(yq e '.data.catalog // "false"' /work/function-config.yaml)" = "true" ] && ARGS+=("--schema-location" "https://raw.githubusercontent.com/datreeio/CRDs-catalog/main/{{.Group}}/{{.ResourceKind}}_{{.ResourceAPIVersion}}.json")
+
+# Split the ResourceList's items into individual manifests
+item_count=$(yq e '.items // [] | length' /work/resource-list.yaml)
+for ((idx = 0; idx < item_count; idx++)); do
+  yq e ".items[$idx]" /work/resource-list.yaml > "/work/items/item-${idx}.yaml"
+done
+
+: > /tmp/results.json
+for item_file in /work/items/*.yaml; do
+  [ -e "$item_file" ] || continue
+  kubeconform "${ARGS[@]}" "$item_file" > /tmp/kubeconform-output.json || true
+  yq e -o=json -I0 '
+    .resources[0] as $r |
+    {
+      "message": ($r.msg // "valid"),
+      "severity": (if $r.status == "invalid" or $r.status == "error" then "error" elif $r.status == "skipped" or $r.status == "empty" then "warning" else "info" end),
+      "resourceRef": {"apiVersion": $r.apiVersion, "kind": $r.kind, "name": $r.name, "namespace": $r.namespace},
+      "file": {"path": "'"$item_file"'"}
+    }
+  ' /tmp/kubeconform-output.json >> /tmp/results.json
+done
+
+yq e '.results = []' /work/resource-list.yaml > /work/resource-list-out.yaml
+while IFS= read -r result; do
+  yq e ".results += [${result}]" -i /work/resource-list-out.yaml
+done < /tmp/results.json
+`
+
+	ctr = ctr.WithNewFile("/work/run_krm.sh", dagger.ContainerWithNewFileOpts{
+		Permissions: 0750,
+		Contents:    scriptContent,
+	})
 
-	return stdout, nil
+	return ctr.WithExec([]string{"bash", "/work/run_krm.sh"}).File("/work/resource-list-out.yaml"), nil
 }